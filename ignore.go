@@ -0,0 +1,204 @@
+// ignore.go
+//
+// Ignore-pattern matching for SyncWatcher, following Syncthing's .stignore
+// syntax closely enough to share ignore files with it:
+//
+//	// line comment
+//	!pattern        re-include a path otherwise excluded by a later pattern
+//	(?i)pattern     case-insensitive match
+//	/pattern        anchored: only matches at the watched folder's root
+//	pattern         matches at any depth
+//	a/**/b          ** matches zero or more path segments
+//
+// Patterns are evaluated in the order they were added; the first one that
+// matches a given path wins.
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+type ignorePattern struct {
+	negate bool
+	regexp *regexp.Regexp
+}
+
+// AddIgnore compiles pattern and appends it to the watcher's ignore list.
+// Blank lines and "//" comments are accepted and silently ignored, so that
+// callers can feed it lines straight out of an .stignore file.
+func (w *SyncWatcher) AddIgnore(pattern string) error {
+	trimmed := strings.TrimSpace(pattern)
+	if trimmed == "" || strings.HasPrefix(trimmed, "//") {
+		return nil
+	}
+
+	compiled, err := compileIgnorePattern(trimmed)
+	if err != nil {
+		return err
+	}
+
+	w.pathMutex.Lock()
+	w.ignores = append(w.ignores, compiled)
+	w.pathMutex.Unlock()
+	return nil
+}
+
+// LoadIgnoreFile reads path line by line and adds each line via AddIgnore,
+// in order. Since the first matching pattern wins, earlier lines take
+// precedence over later ones: a "!" re-include has to come before the
+// pattern it carves an exception out of.
+func (w *SyncWatcher) LoadIgnoreFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if err := w.AddIgnore(scanner.Text()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// isIgnored reports whether path matches an ignore pattern, relative to
+// whichever watched root it falls under.
+func (w *SyncWatcher) isIgnored(path string) bool {
+	w.pathMutex.Lock()
+	defer w.pathMutex.Unlock()
+	return w.isIgnoredLocked(path)
+}
+
+// isIgnoredLocked is isIgnored for callers that already hold pathMutex.
+func (w *SyncWatcher) isIgnoredLocked(path string) bool {
+	if len(w.ignores) == 0 {
+		return false
+	}
+
+	rel := filepath.ToSlash(w.relativeToRootLocked(path))
+	for _, m := range w.ignores {
+		if m.regexp.MatchString(rel) {
+			return !m.negate
+		}
+	}
+	return false
+}
+
+// relativeToRootLocked returns path relative to the longest watched root
+// that contains it, or path unchanged if no root contains it. Callers must
+// hold pathMutex.
+func (w *SyncWatcher) relativeToRootLocked(path string) string {
+	best := ""
+	for root := range w.roots {
+		if len(root) <= len(best) {
+			continue
+		}
+		if path == root || strings.HasPrefix(path, root+string(filepath.Separator)) {
+			best = root
+		}
+	}
+	if best == "" {
+		return path
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(path, best), string(filepath.Separator))
+}
+
+// compileIgnorePattern translates one .stignore line into a compiled
+// matcher. The leading "!" and "(?i)" modifiers, and the anchoring "/"
+// prefix, are stripped and accounted for before the remaining glob body is
+// translated to a regular expression.
+func compileIgnorePattern(pattern string) (*ignorePattern, error) {
+	negate := strings.HasPrefix(pattern, "!")
+	if negate {
+		pattern = pattern[1:]
+	}
+
+	caseInsensitive := strings.HasPrefix(pattern, "(?i)")
+	if caseInsensitive {
+		pattern = pattern[len("(?i)"):]
+	}
+
+	anchored := strings.HasPrefix(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	source := globToRegexpBody(pattern)
+	if anchored {
+		source = "^" + source
+	} else {
+		source = "^(.*/)?" + source
+	}
+	source += "(/.*)?$"
+	if caseInsensitive {
+		source = "(?i)" + source
+	}
+
+	re, err := regexp.Compile(source)
+	if err != nil {
+		return nil, err
+	}
+	return &ignorePattern{negate: negate, regexp: re}, nil
+}
+
+// globToRegexpBody translates the gitignore-style glob body of an stignore
+// pattern ("*", "**", "?") into the body of an equivalent regular
+// expression, escaping everything else that's special to regexp syntax.
+//
+// "**" is handled a path segment at a time, rather than character by
+// character, so that it matches zero or more whole directories: "a/**/c"
+// must match "a/c" as well as "a/x/c" and "a/x/y/c".
+func globToRegexpBody(pattern string) string {
+	segments := strings.Split(pattern, "/")
+
+	var out strings.Builder
+	prevWasDoubleStar := false
+	for i, seg := range segments {
+		if seg == "**" {
+			if i > 0 && !prevWasDoubleStar {
+				out.WriteString("/")
+			}
+			if i == len(segments)-1 {
+				// Trailing "**": anything beneath the preceding directory.
+				out.WriteString(".*")
+			} else {
+				// Zero or more path segments. Folding the following slash
+				// into the group lets it also match nothing at all.
+				out.WriteString("(?:.*/)?")
+			}
+			prevWasDoubleStar = true
+			continue
+		}
+		if i > 0 && !prevWasDoubleStar {
+			out.WriteString("/")
+		}
+		out.WriteString(translateGlobSegment(seg))
+		prevWasDoubleStar = false
+	}
+	return out.String()
+}
+
+// translateGlobSegment translates a single path segment (no "/" in it) of
+// an stignore pattern into the equivalent regular expression fragment.
+func translateGlobSegment(seg string) string {
+	var out strings.Builder
+	for _, c := range seg {
+		switch {
+		case c == '*':
+			out.WriteString("[^/]*")
+		case c == '?':
+			out.WriteString("[^/]")
+		case strings.ContainsRune(`\.+()|[]{}^$`, c):
+			out.WriteByte('\\')
+			out.WriteRune(c)
+		default:
+			out.WriteRune(c)
+		}
+	}
+	return out.String()
+}
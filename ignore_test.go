@@ -0,0 +1,132 @@
+// ignore_test.go
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func newIgnoreSW(t *testing.T, root string, patterns ...string) *SyncWatcher {
+	sw := &SyncWatcher{roots: map[string]int{root: 1}, pathMutex: &sync.Mutex{}}
+	for _, p := range patterns {
+		if err := sw.AddIgnore(p); err != nil {
+			t.Fatalf("AddIgnore(%q) failed: %v", p, err)
+		}
+	}
+	return sw
+}
+
+func TestIgnoreBasic(t *testing.T) {
+	root := "/root/project"
+	sw := newIgnoreSW(t, root, "node_modules")
+
+	if !sw.isIgnored(filepath.Join(root, "node_modules")) {
+		t.Error("expected node_modules to be ignored")
+	}
+	if !sw.isIgnored(filepath.Join(root, "a", "b", "node_modules")) {
+		t.Error("expected nested node_modules to be ignored")
+	}
+	if !sw.isIgnored(filepath.Join(root, "node_modules", "leftpad", "index.js")) {
+		t.Error("expected contents of node_modules to be ignored")
+	}
+	if sw.isIgnored(filepath.Join(root, "src", "main.go")) {
+		t.Error("did not expect unrelated file to be ignored")
+	}
+}
+
+func TestIgnoreAnchored(t *testing.T) {
+	root := "/root/project"
+	sw := newIgnoreSW(t, root, "/build")
+
+	if !sw.isIgnored(filepath.Join(root, "build")) {
+		t.Error("expected root-anchored pattern to match the folder root")
+	}
+	if sw.isIgnored(filepath.Join(root, "vendor", "build")) {
+		t.Error("did not expect root-anchored pattern to match nested directories")
+	}
+}
+
+func TestIgnoreNegate(t *testing.T) {
+	root := "/root/project"
+	// Patterns are evaluated first-match-wins, so the re-include has to be
+	// listed ahead of the broader exclude it carves an exception out of.
+	sw := newIgnoreSW(t, root, "!important.log", "*.log")
+
+	if !sw.isIgnored(filepath.Join(root, "debug.log")) {
+		t.Error("expected *.log to be ignored")
+	}
+	if sw.isIgnored(filepath.Join(root, "important.log")) {
+		t.Error("expected important.log to be re-included")
+	}
+}
+
+func TestIgnoreCaseInsensitive(t *testing.T) {
+	root := "/root/project"
+	sw := newIgnoreSW(t, root, "(?i)readme.md")
+
+	if !sw.isIgnored(filepath.Join(root, "README.MD")) {
+		t.Error("expected (?i) pattern to match case-insensitively")
+	}
+}
+
+func TestIgnoreDoubleStar(t *testing.T) {
+	root := "/root/project"
+	sw := newIgnoreSW(t, root, "a/**/c")
+
+	if !sw.isIgnored(filepath.Join(root, "a", "c")) {
+		t.Error("expected ** to match zero path segments")
+	}
+	if !sw.isIgnored(filepath.Join(root, "a", "b", "c")) {
+		t.Error("expected ** to match one path segment")
+	}
+	if !sw.isIgnored(filepath.Join(root, "a", "x", "y", "c")) {
+		t.Error("expected ** to match multiple path segments")
+	}
+}
+
+func TestIgnoreComment(t *testing.T) {
+	sw := newIgnoreSW(t, "/root/project")
+	if err := sw.AddIgnore("// this is a comment"); err != nil {
+		t.Error("expected comment line to be accepted:", err)
+	}
+	if len(sw.ignores) != 0 {
+		t.Error("expected comment line not to add a pattern")
+	}
+}
+
+func TestLoadIgnoreFile(t *testing.T) {
+	root := "/root/project"
+
+	f, err := os.CreateTemp("", "stignore")
+	if err != nil {
+		t.Fatal("could not create temp ignore file:", err)
+	}
+	defer os.Remove(f.Name())
+
+	contents := "// ignore logs, but keep important.log\n" +
+		"!important.log\n" +
+		"*.log\n"
+	if _, err := f.WriteString(contents); err != nil {
+		t.Fatal("could not write temp ignore file:", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal("could not close temp ignore file:", err)
+	}
+
+	sw := &SyncWatcher{roots: map[string]int{root: 1}, pathMutex: &sync.Mutex{}}
+	if err := sw.LoadIgnoreFile(f.Name()); err != nil {
+		t.Fatal("LoadIgnoreFile failed:", err)
+	}
+
+	if len(sw.ignores) != 2 {
+		t.Fatalf("expected the comment line to be skipped and 2 patterns loaded, got %d", len(sw.ignores))
+	}
+	if !sw.isIgnored(filepath.Join(root, "debug.log")) {
+		t.Error("expected *.log to be ignored")
+	}
+	if sw.isIgnored(filepath.Join(root, "important.log")) {
+		t.Error("expected important.log to be re-included, proving the negation line's ordering survived the file read")
+	}
+}
@@ -18,74 +18,205 @@
 package main
 
 import (
-	"code.google.com/p/go.exp/fsnotify"
 	"errors"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Errors returned or surfaced on the Error channel by SyncWatcher, in
+// addition to whatever the underlying fsnotify.Watcher reports.
+var (
+	// ErrNonExistentWatch is returned when asked to remove a watch for a
+	// path that is not currently watched.
+	ErrNonExistentWatch = errors.New("syncwatcher: no such watch")
+
+	// ErrEventOverflow is surfaced on the Error channel when the
+	// underlying watcher's event queue overflowed (e.g. inotify hit
+	// fs.inotify.max_queued_events). Some events between the overflow and
+	// the next recognised event may have been lost; callers should treat
+	// this as a signal to fall back to a full rescan of the watched
+	// trees rather than trusting the event stream alone.
+	ErrEventOverflow = errors.New("syncwatcher: event queue overflow, rescan recommended")
+
+	// ErrNotDirectory is returned when asked to watch a path that is not
+	// a directory.
+	ErrNotDirectory = errors.New("syncwatcher: not a directory")
 )
 
 type SyncWatcher struct {
 	Error chan error
-	Event chan *fsnotify.FileEvent
+	Event chan fsnotify.Event
+	// Batch delivers debounced, coalesced events: see NewSyncWatcherWithDelay.
+	// It is nil unless the watcher was constructed with a positive delay.
+	Batch chan []fsnotify.Event
 
-	watcher   *fsnotify.Watcher
-	paths     map[string]string
-	roots     map[string]int
+	watcher    *fsnotify.Watcher
+	paths      map[string]string
+	roots      map[string]int
+	snapshots  map[string]map[string]time.Time
+	ignores    []*ignorePattern
+	maxWatches int
+	polling    map[string]chan struct{}
+	pollWG     sync.WaitGroup
+	// toBatcher mirrors every event also sent on Event, for runBatcher to
+	// coalesce; nil unless the watcher was constructed with a positive
+	// delay. Kept on the struct, rather than a local in newSyncWatcher, so
+	// that pollLoop can feed it too.
+	toBatcher chan fsnotify.Event
 	pathMutex *sync.Mutex
+	// closing is set by Close, under pathMutex, before anything is torn
+	// down. watch and rewatch, the only callers of reportWatchLimitLocked
+	// and startPollingLocked, check it first, also under pathMutex, so that
+	// once Close has set it there is no further window in which a fresh
+	// watch-limit send on Error or a fresh pollLoop goroutine can be raced
+	// against the channels Close is about to close.
+	closing bool
 }
 
+// NewSyncWatcher returns a SyncWatcher with no event coalescing: every raw
+// event is delivered on Event as soon as it arrives. Use
+// NewSyncWatcherWithDelay to additionally get a debounced Batch channel.
 func NewSyncWatcher() (*SyncWatcher, error) {
+	return newSyncWatcher(0)
+}
+
+// NewSyncWatcherWithDelay returns a SyncWatcher whose Batch channel collapses
+// events for the same path that arrive within delay of each other into a
+// single coalesced event, the way Syncthing's own watcher debounces its
+// filesystem events (see FSWatcherDelayS). The raw, uncoalesced stream
+// remains available on Event for callers that want firehose access.
+func NewSyncWatcherWithDelay(delay time.Duration) (*SyncWatcher, error) {
+	return newSyncWatcher(delay)
+}
+
+func newSyncWatcher(delay time.Duration) (*SyncWatcher, error) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return nil, err
 	}
 
 	sw := &SyncWatcher{
-		make(chan error),
-		make(chan *fsnotify.FileEvent),
-		watcher,
-		make(map[string]string),
-		make(map[string]int),
-		&sync.Mutex{},
+		Error:     make(chan error),
+		Event:     make(chan fsnotify.Event),
+		watcher:   watcher,
+		paths:     make(map[string]string),
+		roots:     make(map[string]int),
+		snapshots: make(map[string]map[string]time.Time),
+		pathMutex: &sync.Mutex{},
+	}
+
+	if delay > 0 {
+		sw.Batch = make(chan []fsnotify.Event)
+		sw.toBatcher = make(chan fsnotify.Event, 4096)
+		go sw.runBatcher(sw.toBatcher, delay)
 	}
 
-	// Handle events from fsnotify,d eal with them,
+	// Handle events from fsnotify, deal with them,
 	// and forward the interesting ones to the caller
 	go func() {
 		var (
-			ev  *fsnotify.FileEvent
+			ev  fsnotify.Event
 			err error
 		)
 		// Loop until both incoming channels are closed
 		for openEvent, openErr := true, true; openEvent || openErr; {
 			select {
-			case ev, openEvent = <-watcher.Event:
+			case ev, openEvent = <-watcher.Events:
 				if openEvent {
 					// Add or remove watches as appropriate
 					sw.pathMutex.Lock()
 					_, present := sw.paths[ev.Name]
 					sw.pathMutex.Unlock()
-					if present {
-						// If we recognise the path then it must be a directory
-						// that means its changed, and the old watches must be
-						// removed.  New watches will be added when the corresponding
-						// "create" event arrives.
-						// This uses "removeWatch" not "RemoveWatch" on purpose
+					emit := func(ev fsnotify.Event) {
+						if sw.isIgnored(ev.Name) {
+							return
+						}
+						sw.Event <- ev
+						if sw.toBatcher != nil {
+							sw.toBatcher <- ev
+						}
+					}
+					switch {
+					case present && ev.Op.Has(fsnotify.Remove):
+						// The directory itself was removed. The old watches
+						// must be removed; new ones will be added when the
+						// corresponding "create" event arrives. This uses
+						// "removeWatch" not "RemoveWatch" on purpose.
 						sw.removeWatch(ev.Name)
-					} else if info, err := os.Lstat(ev.Name); err == nil && info.IsDir() {
-						// A new, unrecognised directory was created.
-						sw.watch(ev.Name)
+						emit(ev)
+					case present && ev.Op.Has(fsnotify.Rename):
+						// A watched directory was renamed. This fires twice
+						// for a move within a watched tree: once as the
+						// parent's report of the move (fsnotify resolves the
+						// old path by watch descriptor - ev.Name is the
+						// directory's old path, which is no longer present
+						// anywhere on disk), and once as the moved
+						// directory's own IN_MOVE_SELF. fsnotify always
+						// auto-unwatches a directory's own watch descriptor
+						// on its self-rename - and if we've *also* just
+						// re-Added a watch on its new path (handled via the
+						// parent's paired "create" event, below) before
+						// fsnotify gets to decode that self-event, fsnotify's
+						// watch-descriptor lookup resolves to our fresh
+						// entry, so the self-event's Name comes through as
+						// the *new* path instead, and the matching teardown
+						// then kills the kernel watch we just re-added out
+						// from under us.
+						//
+						// Lstat tells the two occurrences apart: if ev.Name
+						// is gone, this is the authoritative report of the
+						// move and our bookkeeping needs clearing. If it
+						// still exists, this is the self-event arriving
+						// under the new path, and the fix above is to simply
+						// re-establish the watch fsnotify just (redundantly)
+						// tore down for us.
+						if _, err := os.Lstat(ev.Name); err != nil {
+							sw.removeWatchForRename(ev.Name)
+						} else {
+							sw.rewatch(ev.Name)
+						}
+						emit(ev)
+					case present && ev.Op.Has(fsnotify.Write):
+						// kqueue (Darwin/BSD) and FEN (illumos) only report
+						// a Write on the directory itself, without saying
+						// which child did it. Re-list the directory and
+						// synthesize the Create/Rename/Remove events that
+						// inotify would have given us directly.
+						for _, synthetic := range sw.rescanDir(ev.Name) {
+							emit(synthetic)
+						}
+					case present:
+						// Some other event on the directory itself, e.g.
+						// inotify's Chmod on a permission change: nothing to
+						// rescan, just forward it as-is.
+						emit(ev)
+					default:
+						if ev.Op.Has(fsnotify.Create) {
+							if info, err := os.Lstat(ev.Name); err == nil && info.IsDir() {
+								// A new, unrecognised directory was created.
+								sw.watch(ev.Name)
+							}
+						}
+						emit(ev)
 					}
-
-					// Forward the event to our client.
-					sw.Event <- ev
 				}
-			case err, openErr = <-watcher.Error:
+			case err, openErr = <-watcher.Errors:
 				if openErr {
-					// Forward error events to our client
-					sw.Error <- err
+					if err == fsnotify.ErrEventOverflow {
+						// The queue overflowed: some events may have been
+						// lost, so surface our own sentinel in place of the
+						// underlying one and let the caller decide to
+						// rescan.
+						sw.Error <- ErrEventOverflow
+					} else {
+						// Forward error events to our client
+						sw.Error <- err
+					}
 				}
 			}
 		}
@@ -93,12 +224,152 @@ func NewSyncWatcher() (*SyncWatcher, error) {
 		// so close the outgoing channels.
 		close(sw.Event)
 		close(sw.Error)
+		if sw.toBatcher != nil {
+			close(sw.toBatcher)
+		}
 	}()
 
 	return sw, nil
 }
 
+// runBatcher accumulates raw events arriving on in and, after each quiet
+// period of at least delay with no new arrivals, coalesces the accumulated
+// burst and delivers it on sw.Batch. It exits once in is closed and drained.
+func (w *SyncWatcher) runBatcher(in chan fsnotify.Event, delay time.Duration) {
+	var pending []fsnotify.Event
+
+	timer := time.NewTimer(delay)
+	if !timer.Stop() {
+		<-timer.C
+	}
+
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		batch := coalesce(pending)
+		pending = nil
+		if len(batch) > 0 {
+			w.Batch <- batch
+		}
+	}
+
+	for {
+		select {
+		case ev, ok := <-in:
+			if !ok {
+				flush()
+				close(w.Batch)
+				return
+			}
+			pending = append(pending, ev)
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(delay)
+		case <-timer.C:
+			flush()
+		}
+	}
+}
+
+// coalesce collapses a burst of raw events into the minimal set describing
+// their net effect over the debounce window:
+//   - repeated events for the same path are merged (their Op bits combined)
+//   - a Write/Chmod following a Create for the same path is absorbed into
+//     the Create, since the file is new regardless of what was written to
+//     it a moment later
+//   - a Remove following a Create for the same path cancels out
+//   - a Rename "from" immediately followed by a Create "to" a different path,
+//     the usual shape of a move under this library's fsnotify backends,
+//     collapses into a single Rename|Create event on the destination path
+//   - a directory event absorbs events for any path beneath it, since the
+//     directory's own event already signals that something below it changed
+func coalesce(events []fsnotify.Event) []fsnotify.Event {
+	var order []string
+	merged := make(map[string]fsnotify.Op)
+	pendingRename := ""
+
+	for _, ev := range events {
+		if pendingRename != "" && ev.Name != pendingRename && ev.Op.Has(fsnotify.Create) {
+			delete(merged, pendingRename)
+			_, seen := merged[ev.Name]
+			merged[ev.Name] = fsnotify.Rename | fsnotify.Create
+			if !seen {
+				order = append(order, ev.Name)
+			}
+			pendingRename = ""
+			continue
+		}
+		pendingRename = ""
+
+		op, seen := merged[ev.Name]
+		switch {
+		case op.Has(fsnotify.Create) && ev.Op.Has(fsnotify.Remove):
+			// Created then removed inside the same window: net no-op.
+			delete(merged, ev.Name)
+			continue
+		case op.Has(fsnotify.Create) && (ev.Op.Has(fsnotify.Write) || ev.Op.Has(fsnotify.Chmod)):
+			// Still just a create.
+		default:
+			merged[ev.Name] = op | ev.Op
+		}
+		if !seen {
+			order = append(order, ev.Name)
+		}
+		if ev.Op.Has(fsnotify.Rename) {
+			pendingRename = ev.Name
+		}
+	}
+
+	result := make([]fsnotify.Event, 0, len(order))
+	for _, name := range order {
+		if op, ok := merged[name]; ok {
+			result = append(result, fsnotify.Event{Name: name, Op: op})
+			// A path dropped and then seen again is in order twice.
+			delete(merged, name)
+		}
+	}
+
+	final := make([]fsnotify.Event, 0, len(result))
+	for _, ev := range result {
+		underDir := false
+		for _, other := range result {
+			if other.Name != ev.Name && strings.HasPrefix(ev.Name, other.Name+string(filepath.Separator)) {
+				underDir = true
+				break
+			}
+		}
+		if !underDir {
+			final = append(final, ev)
+		}
+	}
+	return final
+}
+
 func (w *SyncWatcher) Close() error {
+	// Mark w as closing and stop every polling fallback goroutine (see
+	// startPollingLocked) in the same critical section: setting closing
+	// here, under pathMutex, stops watch/rewatch from registering a new
+	// poll or attempting a fresh watch-limit send on Error (they check
+	// w.closing under the same lock) after this point, so the sweep over
+	// w.polling below is guaranteed to see every poll goroutine that will
+	// ever exist. Without that guarantee, one could be started in the
+	// gap between this sweep and watcher.Close() below, never get told
+	// to stop, and panic sending on a channel fsnotify's own shutdown
+	// then closes out from under it.
+	w.pathMutex.Lock()
+	w.closing = true
+	for path, stop := range w.polling {
+		close(stop)
+		delete(w.polling, path)
+	}
+	w.pathMutex.Unlock()
+	w.pollWG.Wait()
+
 	// We close the fsnotify watcher.
 	// That will close our incoming channels, and so close the SyncWatcher
 	// indirectly.
@@ -111,31 +382,77 @@ func (w *SyncWatcher) Close() error {
 
 // This is like RemoveWatch except that it does not unwatch the root directory.
 func (w *SyncWatcher) removeWatch(path string) error {
+	return w.removeWatchInternal(path, true)
+}
+
+// removeWatchForRename is like removeWatch, except it leaves the fsnotify
+// watch on path itself alone: fsnotify's inotify backend auto-unwatches a
+// directory on the kernel's IN_MOVE_SELF, and still has that raw event
+// queued by the time our event-pump goroutine gets here. Calling the
+// public Remove ourselves races fsnotify's own decode of that queued
+// event, which resolves the self-event's Name by looking the watch up by
+// descriptor - if we win the race, that lookup misses and the self-event
+// is forwarded with an empty Name. Subdirectories don't get that
+// automatic cleanup on a parent rename, so they're still unwatched
+// explicitly here.
+func (w *SyncWatcher) removeWatchForRename(path string) error {
+	return w.removeWatchInternal(path, false)
+}
+
+// removeWatchInternal is removeWatch and removeWatchForRename's shared
+// implementation. When removeFsnotifyWatch is false, path's own fsnotify
+// watch is left in place (see removeWatchForRename); its subdirectories
+// are always unwatched via fsnotify's public Remove.
+func (w *SyncWatcher) removeWatchInternal(path string, removeFsnotifyWatch bool) error {
 	w.pathMutex.Lock()
 	defer w.pathMutex.Unlock()
 
 	// Recursively remove all the watches from the given directory, and its
 	// subdirectories. The root directory will not be unwatched (RemoveWatch
 	// takes care of that).
-	var recursive_remove func(dir string) error
-	recursive_remove = func(dir string) error {
+	var recursive_remove func(dir string, removeFsnotifyWatch bool) error
+	recursive_remove = func(dir string, removeFsnotifyWatch bool) error {
 		children, ok := w.paths[dir]
 		if ok {
 			for _, child := range strings.Split(children, "\000") {
 				if len(child) > 0 {
 					// deliberately ignore errors from child watches
-					recursive_remove(filepath.Join(dir, child))
+					recursive_remove(filepath.Join(dir, child), true)
 				}
 			}
 			if _, isroot := w.roots[dir]; !isroot {
 				delete(w.paths, dir)
-				return w.watcher.RemoveWatch(dir)
+				delete(w.snapshots, dir)
+				if removeFsnotifyWatch {
+					return w.watcher.Remove(dir)
+				}
+				return nil
 			}
 		}
-		return errors.New("cannot remove uknown watch: " + dir)
+		return ErrNonExistentWatch
+	}
+
+	return recursive_remove(path, removeFsnotifyWatch)
+}
+
+// rewatch re-adds the native watch for path, which is already tracked in
+// w.paths, after fsnotify tore its underlying watch down as a side effect
+// of decoding that directory's own IN_MOVE_SELF (see the Rename case in
+// newSyncWatcher's event pump). Unlike watch, it doesn't walk
+// subdirectories or touch the parent's child-name bookkeeping: path is
+// already fully tracked, only its fsnotify-level watch needs restoring.
+func (w *SyncWatcher) rewatch(path string) {
+	w.pathMutex.Lock()
+	defer w.pathMutex.Unlock()
+
+	if w.closing {
+		return
 	}
 
-	return recursive_remove(path)
+	if addErr := w.watcher.Add(path); isWatchLimitError(addErr) {
+		w.reportWatchLimitLocked(path)
+		w.startPollingLocked(path)
+	}
 }
 
 func (w *SyncWatcher) RemoveWatch(path string) error {
@@ -146,33 +463,153 @@ func (w *SyncWatcher) RemoveWatch(path string) error {
 		delete(w.roots, path)
 	}
 	w.pathMutex.Unlock()
-	return w.removeWatch(path)
+	err := w.removeWatch(path)
+
+	w.pathMutex.Lock()
+	for pollPath, stop := range w.polling {
+		if pollPath == path || strings.HasPrefix(pollPath, path+string(filepath.Separator)) {
+			close(stop)
+			delete(w.polling, pollPath)
+		}
+	}
+	w.pathMutex.Unlock()
+
+	return err
 }
 
 func (w *SyncWatcher) watch(path string) error {
 	w.pathMutex.Lock()
 	defer w.pathMutex.Unlock()
 
+	if w.closing {
+		return nil
+	}
+
 	filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
-		if err == nil && info.IsDir() {
-			err = w.watcher.Watch(path)
-			if err == nil {
-				w.paths[path] = ""
-				parent := filepath.Dir(path)
-				if _, ok := w.paths[parent]; ok {
-					// Record the directory structure so that it can be
-					// walked again when we need to remove the watches.
-					w.paths[parent] += filepath.Base(path) + "\000"
-				}
+		if err != nil || !info.IsDir() {
+			return err
+		}
+		if w.isIgnoredLocked(path) {
+			// Don't spend a watch descriptor on an ignored tree, e.g. a
+			// node_modules directory.
+			return filepath.SkipDir
+		}
+		if w.maxWatches > 0 && len(w.paths) >= w.maxWatches {
+			// We're at our self-imposed cap: fall back to polling this
+			// subtree instead of adding another native watch.
+			w.reportWatchLimitLocked(path)
+			w.startPollingLocked(path)
+			return filepath.SkipDir
+		}
+
+		addErr := w.watcher.Add(path)
+		if isWatchLimitError(addErr) {
+			// The platform itself is out of watch descriptors (e.g.
+			// fs.inotify.max_user_watches): same fallback.
+			w.reportWatchLimitLocked(path)
+			w.startPollingLocked(path)
+			return filepath.SkipDir
+		}
+		if addErr == nil {
+			w.paths[path] = ""
+			w.snapshots[path] = snapshotDir(path)
+			parent := filepath.Dir(path)
+			if _, ok := w.paths[parent]; ok {
+				// Record the directory structure so that it can be
+				// walked again when we need to remove the watches.
+				w.paths[parent] += filepath.Base(path) + "\000"
 			}
 		}
-		return err
+		return addErr
 	})
 
 	return nil
 }
 
+// snapshotDir returns the immediate children of path and their mtimes, used
+// as a baseline to diff against on a later rescan. Errors reading the
+// directory (e.g. it has since been removed) yield an empty snapshot.
+func snapshotDir(path string) map[string]time.Time {
+	snapshot := make(map[string]time.Time)
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return snapshot
+	}
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil {
+			snapshot[entry.Name()] = info.ModTime()
+		}
+	}
+	return snapshot
+}
+
+// rescanDir re-lists dirPath and diffs it against the snapshot taken the
+// last time we watched or rescanned it, synthesizing the Create/Rename/
+// Remove events implied by the difference. New subdirectories are watched
+// recursively, exactly as the inotify path does when it sees a real Create
+// event. The snapshot is replaced atomically under pathMutex.
+func (w *SyncWatcher) rescanDir(dirPath string) []fsnotify.Event {
+	newSnapshot := snapshotDir(dirPath)
+
+	w.pathMutex.Lock()
+	oldSnapshot := w.snapshots[dirPath]
+	w.snapshots[dirPath] = newSnapshot
+	w.pathMutex.Unlock()
+
+	var added, removed []string
+	for name := range newSnapshot {
+		if _, ok := oldSnapshot[name]; !ok {
+			added = append(added, name)
+		}
+	}
+	for name := range oldSnapshot {
+		if _, ok := newSnapshot[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+
+	var events []fsnotify.Event
+	for _, name := range added {
+		childPath := filepath.Join(dirPath, name)
+		if w.isIgnored(childPath) {
+			continue
+		}
+
+		// A vanished entry with the same mtime as a new one is almost
+		// certainly the old name of a rename, rather than an unrelated
+		// delete and create.
+		for i, oldName := range removed {
+			if oldSnapshot[oldName].Equal(newSnapshot[name]) {
+				events = append(events, fsnotify.Event{Name: filepath.Join(dirPath, oldName), Op: fsnotify.Rename})
+				removed = append(removed[:i], removed[i+1:]...)
+				break
+			}
+		}
+
+		events = append(events, fsnotify.Event{Name: childPath, Op: fsnotify.Create})
+		if info, err := os.Lstat(childPath); err == nil && info.IsDir() {
+			w.watch(childPath)
+		}
+	}
+	for _, name := range removed {
+		childPath := filepath.Join(dirPath, name)
+		if w.isIgnored(childPath) {
+			continue
+		}
+		events = append(events, fsnotify.Event{Name: childPath, Op: fsnotify.Remove})
+	}
+
+	return events
+}
+
 func (w *SyncWatcher) Watch(path string) error {
+	if info, err := os.Lstat(path); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return ErrNotDirectory
+	}
+
 	w.pathMutex.Lock()
 	_, present := w.paths[path]
 
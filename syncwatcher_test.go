@@ -2,13 +2,15 @@
 package main
 
 import (
-	"code.google.com/p/go.exp/fsnotify"
 	"fmt"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/fsnotify/fsnotify"
 )
 
 var tmpdir string
@@ -61,7 +63,7 @@ func removeAll(t *testing.T, path string) {
 	return
 }
 
-func expectEvent(t *testing.T, sw *SyncWatcher) (ev *fsnotify.FileEvent, ok bool) {
+func expectEvent(t *testing.T, sw *SyncWatcher) (ev fsnotify.Event, ok bool) {
 	timeout := time.After(time.Second * 2)
 	select {
 	case ev, ok = <-sw.Event:
@@ -80,7 +82,7 @@ func expectEvent(t *testing.T, sw *SyncWatcher) (ev *fsnotify.FileEvent, ok bool
 
 func expectClosed(t *testing.T, sw *SyncWatcher) {
 	timeout := time.After(time.Second * 2)
-	var ev *fsnotify.FileEvent
+	var ev fsnotify.Event
 	var err error
 Loop:
 	for ok, eok := true, true; ok || eok; {
@@ -114,18 +116,18 @@ func TestWatchFiles(t *testing.T) {
 	// Test: File creation
 	createEmptyFile(t, file1)
 	ev, ok := expectEvent(t, sw)
-	if !ok || !ev.IsCreate() || ev.Name != file1 {
+	if !ok || !ev.Op.Has(fsnotify.Create) || ev.Name != file1 {
 		t.Error("Expected file create event")
 	}
 
 	// Test: File rename
 	os.Rename(file1, file2)
 	ev, ok = expectEvent(t, sw)
-	if !ok || !ev.IsRename() || ev.Name != file1 {
+	if !ok || !ev.Op.Has(fsnotify.Rename) || ev.Name != file1 {
 		t.Error("Expected file rename event")
 	}
 	ev, ok = expectEvent(t, sw)
-	if !ok || !ev.IsCreate() || ev.Name != file2 {
+	if !ok || !ev.Op.Has(fsnotify.Create) || ev.Name != file2 {
 		t.Error("Expected file create event")
 	}
 
@@ -137,14 +139,14 @@ func TestWatchFiles(t *testing.T) {
 	fmt.Fprintln(fd, "blah blah blah")
 	fd.Close()
 	ev, ok = expectEvent(t, sw)
-	if !ok || !ev.IsModify() || ev.Name != file2 {
+	if !ok || !ev.Op.Has(fsnotify.Write) || ev.Name != file2 {
 		t.Error("Expected file modify event")
 	}
 
 	// Test: File deletion
 	os.Remove(file2)
 	ev, ok = expectEvent(t, sw)
-	if !ok || !ev.IsDelete() || ev.Name != file2 {
+	if !ok || !ev.Op.Has(fsnotify.Remove) || ev.Name != file2 {
 		t.Error("Expected file delete event")
 	}
 
@@ -173,7 +175,7 @@ func TestRecursiveWatch(t *testing.T) {
 	// Test: Directory creation
 	mkdir(t, dir1)
 	ev, ok := expectEvent(t, sw)
-	if !ok || !ev.IsCreate() || ev.Name != dir1 {
+	if !ok || !ev.Op.Has(fsnotify.Create) || ev.Name != dir1 {
 		t.Error("Expected directory create event")
 	}
 
@@ -189,22 +191,28 @@ func TestRecursiveWatch(t *testing.T) {
 	file1 := filepath.Join(dir1, "c")
 	createEmptyFile(t, file1)
 	ev, ok = expectEvent(t, sw)
-	if !ok || !ev.IsCreate() || ev.Name != file1 {
+	if !ok || !ev.Op.Has(fsnotify.Create) || ev.Name != file1 {
 		t.Error("Expected file create event")
 	}
 
 	// Test: Directory rename
 	os.Rename(dir1, dir2)
 	ev, ok = expectEvent(t, sw)
-	if !ok || !ev.IsRename() || ev.Name != dir1 {
+	if !ok || !ev.Op.Has(fsnotify.Rename) || ev.Name != dir1 {
 		t.Error("Expected directory rename event")
 	}
 	ev, ok = expectEvent(t, sw)
-	if !ok || !ev.IsCreate() || ev.Name != dir2 {
+	if !ok || !ev.Op.Has(fsnotify.Create) || ev.Name != dir2 {
 		t.Error("Expected directory create event")
 	}
+	// The renamed directory's own watch reports this as a third event,
+	// distinct from the parent-reported pair above: handling the "create"
+	// event re-Adds a watch on dir2, which fsnotify's inotify backend maps
+	// to the moved directory's existing watch descriptor before it decodes
+	// that watch's IN_MOVE_SELF, so the self-event's Name is already dir2
+	// by the time it reaches us.
 	ev, ok = expectEvent(t, sw)
-	if !ok || !ev.IsRename() || ev.Name != dir1 {
+	if !ok || !ev.Op.Has(fsnotify.Rename) || ev.Name != dir2 {
 		t.Error("Expected directory rename event")
 	}
 
@@ -223,26 +231,26 @@ func TestRecursiveWatch(t *testing.T) {
 	file2 := filepath.Join(dir2, "d")
 	createEmptyFile(t, file2)
 	ev, ok = expectEvent(t, sw)
-	if !ok || !ev.IsCreate() || ev.Name != file2 {
+	if !ok || !ev.Op.Has(fsnotify.Create) || ev.Name != file2 {
 		t.Error("Expected file create event")
 	}
 
 	// Test: Directory deletion
 	removeAll(t, dir2)
 	ev, ok = expectEvent(t, sw)
-	if !ok || !ev.IsDelete() || (ev.Name != file1 && ev.Name != file2) {
+	if !ok || !ev.Op.Has(fsnotify.Remove) || (ev.Name != file1 && ev.Name != file2) {
 		t.Error("Expected file delete event")
 	}
 	ev, ok = expectEvent(t, sw)
-	if !ok || !ev.IsDelete() || (ev.Name != file1 && ev.Name != file2) {
+	if !ok || !ev.Op.Has(fsnotify.Remove) || (ev.Name != file1 && ev.Name != file2) {
 		t.Error("Expected directory delete event")
 	}
 	ev, ok = expectEvent(t, sw)
-	if !ok || !ev.IsDelete() || ev.Name != dir2 {
+	if !ok || !ev.Op.Has(fsnotify.Remove) || ev.Name != dir2 {
 		t.Error("Expected directory delete event")
 	}
 	ev, ok = expectEvent(t, sw)
-	if !ok || !ev.IsDelete() || ev.Name != dir2 {
+	if !ok || !ev.Op.Has(fsnotify.Remove) || ev.Name != dir2 {
 		t.Error("Expected directory delete event")
 	}
 
@@ -293,7 +301,7 @@ func TestMoveIn(t *testing.T) {
 	// Test: Move external directory in
 	os.Rename(createdir, moveddir)
 	ev, ok := expectEvent(t, sw)
-	if !ok || !ev.IsCreate() || ev.Name != moveddir {
+	if !ok || !ev.Op.Has(fsnotify.Create) || ev.Name != moveddir {
 		t.Error("Expected directory create event")
 	}
 
@@ -310,6 +318,50 @@ func TestMoveIn(t *testing.T) {
 	expectClosed(t, sw)
 }
 
+func TestCoalesce(t *testing.T) {
+	file := filepath.Join(watchdir, "a")
+	dir := watchdir
+
+	// Create+Write+Write -> Create
+	got := coalesce([]fsnotify.Event{
+		{Name: file, Op: fsnotify.Create},
+		{Name: file, Op: fsnotify.Write},
+		{Name: file, Op: fsnotify.Write},
+	})
+	if !reflect.DeepEqual(got, []fsnotify.Event{{Name: file, Op: fsnotify.Create}}) {
+		t.Error("expected Create+Write+Write to collapse to Create, got:", got)
+	}
+
+	// Create+Remove -> dropped entirely
+	got = coalesce([]fsnotify.Event{
+		{Name: file, Op: fsnotify.Create},
+		{Name: file, Op: fsnotify.Remove},
+	})
+	if len(got) != 0 {
+		t.Error("expected Create+Remove to be dropped, got:", got)
+	}
+
+	// Rename-from + Create-to -> single Rename event on the new path
+	file2 := filepath.Join(watchdir, "b")
+	got = coalesce([]fsnotify.Event{
+		{Name: file, Op: fsnotify.Rename},
+		{Name: file2, Op: fsnotify.Create},
+	})
+	want := []fsnotify.Event{{Name: file2, Op: fsnotify.Rename | fsnotify.Create}}
+	if !reflect.DeepEqual(got, want) {
+		t.Error("expected rename pairing, got:", got, "want:", want)
+	}
+
+	// A directory event absorbs events for paths beneath it
+	got = coalesce([]fsnotify.Event{
+		{Name: file, Op: fsnotify.Write},
+		{Name: dir, Op: fsnotify.Write},
+	})
+	if !reflect.DeepEqual(got, []fsnotify.Event{{Name: dir, Op: fsnotify.Write}}) {
+		t.Error("expected directory event to absorb file event beneath it, got:", got)
+	}
+}
+
 func TestMoveOut(t *testing.T) {
 	mkdir(t, watchdir)
 	defer removeAll(t, watchdir)
@@ -334,7 +386,7 @@ func TestMoveOut(t *testing.T) {
 	mkdir(t, createdir)
 	mkdir(t, filepath.Join(createdir, "subdir"))
 	ev, ok := expectEvent(t, sw)
-	if !ok || !ev.IsCreate() || ev.Name != createdir {
+	if !ok || !ev.Op.Has(fsnotify.Create) || ev.Name != createdir {
 		t.Error("Expected directory create event")
 	}
 
@@ -350,16 +402,16 @@ func TestMoveOut(t *testing.T) {
 	// Test: Move directory out of the watched area
 	os.Rename(createdir, moveddir)
 	ev, ok = expectEvent(t, sw)
-	if ok && ev.IsCreate() && ev.Name == filepath.Join(createdir, "subdir") {
+	if ok && ev.Op.Has(fsnotify.Create) && ev.Name == filepath.Join(createdir, "subdir") {
 		// There's a race condition in the previous test
 		// This create event is not required, but OK, so skip it
 		ev, ok = expectEvent(t, sw)
 	}
-	if !ok || !ev.IsRename() || ev.Name != createdir {
+	if !ok || !ev.Op.Has(fsnotify.Rename) || ev.Name != createdir {
 		t.Error("Expected directory rename event")
 	}
 	ev, ok = expectEvent(t, sw)
-	if !ok || !ev.IsRename() || ev.Name != createdir {
+	if !ok || !ev.Op.Has(fsnotify.Rename) || ev.Name != createdir {
 		t.Error("Expected directory rename event")
 	}
 
@@ -375,3 +427,136 @@ func TestMoveOut(t *testing.T) {
 	sw.Close()
 	expectClosed(t, sw)
 }
+
+func TestSnapshotDir(t *testing.T) {
+	dir := filepath.Join(tmpdir, fmt.Sprintf("snapshotdir.%d", os.Getpid()))
+	mkdir(t, dir)
+	defer removeAll(t, dir)
+
+	createEmptyFile(t, filepath.Join(dir, "a"))
+	createEmptyFile(t, filepath.Join(dir, "b"))
+
+	snap := snapshotDir(dir)
+	if _, ok := snap["a"]; !ok {
+		t.Error("expected snapshot to include \"a\"")
+	}
+	if _, ok := snap["b"]; !ok {
+		t.Error("expected snapshot to include \"b\"")
+	}
+	if len(snap) != 2 {
+		t.Error("expected exactly 2 entries, got", snap)
+	}
+
+	// A directory that can't be read (e.g. it's gone) yields an empty
+	// snapshot rather than an error.
+	if got := snapshotDir(filepath.Join(dir, "does-not-exist")); len(got) != 0 {
+		t.Error("expected empty snapshot for a nonexistent directory, got", got)
+	}
+}
+
+// newRescanSW builds a SyncWatcher sufficient to exercise rescanDir
+// directly, without a real fsnotify.Watcher: rescanDir only reaches into
+// w.watcher for new subdirectories, so the tests below stick to plain
+// files.
+func newRescanSW(root string) *SyncWatcher {
+	return &SyncWatcher{
+		roots:     map[string]int{root: 1},
+		paths:     map[string]string{root: ""},
+		snapshots: make(map[string]map[string]time.Time),
+		pathMutex: &sync.Mutex{},
+	}
+}
+
+func TestRescanDirCreateAndRemove(t *testing.T) {
+	dir := filepath.Join(tmpdir, fmt.Sprintf("rescandir.%d", os.Getpid()))
+	mkdir(t, dir)
+	defer removeAll(t, dir)
+
+	sw := newRescanSW(dir)
+	sw.snapshots[dir] = snapshotDir(dir)
+
+	newFile := filepath.Join(dir, "new")
+	createEmptyFile(t, newFile)
+
+	events := sw.rescanDir(dir)
+	if len(events) != 1 || !events[0].Op.Has(fsnotify.Create) || events[0].Name != newFile {
+		t.Fatalf("expected a single create event for %q, got %v", newFile, events)
+	}
+
+	os.Remove(newFile)
+	events = sw.rescanDir(dir)
+	if len(events) != 1 || !events[0].Op.Has(fsnotify.Remove) || events[0].Name != newFile {
+		t.Fatalf("expected a single remove event for %q, got %v", newFile, events)
+	}
+}
+
+func TestRescanDirRename(t *testing.T) {
+	dir := filepath.Join(tmpdir, fmt.Sprintf("rescanrename.%d", os.Getpid()))
+	mkdir(t, dir)
+	defer removeAll(t, dir)
+
+	oldName := filepath.Join(dir, "old")
+	createEmptyFile(t, oldName)
+
+	sw := newRescanSW(dir)
+	sw.snapshots[dir] = snapshotDir(dir)
+
+	newName := filepath.Join(dir, "new")
+	if err := os.Rename(oldName, newName); err != nil {
+		t.Fatal(err)
+	}
+
+	events := sw.rescanDir(dir)
+	if len(events) != 2 {
+		t.Fatalf("expected a rename+create pair, got %v", events)
+	}
+	if !events[0].Op.Has(fsnotify.Rename) || events[0].Name != oldName {
+		t.Errorf("expected the first event to be a rename of the old name, got %v", events[0])
+	}
+	if !events[1].Op.Has(fsnotify.Create) || events[1].Name != newName {
+		t.Errorf("expected the second event to be a create of the new name, got %v", events[1])
+	}
+}
+
+func TestBatchDelay(t *testing.T) {
+	dir := filepath.Join(tmpdir, fmt.Sprintf("batchdelay.%d", os.Getpid()))
+	mkdir(t, dir)
+	defer removeAll(t, dir)
+
+	sw, err := NewSyncWatcherWithDelay(100 * time.Millisecond)
+	if sw == nil || err != nil {
+		t.Fatal("NewSyncWatcherWithDelay failed:", err)
+	}
+	watch(t, sw, dir)
+
+	// Drain Event in the background: it's unbuffered, and we only care
+	// about what comes out the other end on Batch.
+	go func() {
+		for range sw.Event {
+		}
+	}()
+
+	file1 := filepath.Join(dir, "a")
+	file2 := filepath.Join(dir, "b")
+	createEmptyFile(t, file1)
+	createEmptyFile(t, file2)
+
+	timeout := time.After(2 * time.Second)
+	select {
+	case batch, ok := <-sw.Batch:
+		if !ok {
+			t.Fatal("Batch channel closed unexpectedly")
+		}
+		if len(batch) != 2 {
+			t.Fatalf("expected a single coalesced batch of 2 creates, got %v", batch)
+		}
+		names := map[string]bool{batch[0].Name: true, batch[1].Name: true}
+		if !names[file1] || !names[file2] {
+			t.Errorf("expected creates for %s and %s, got %v", file1, file2, batch)
+		}
+	case <-timeout:
+		t.Fatal("no batch received")
+	}
+
+	sw.Close()
+}
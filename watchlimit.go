@@ -0,0 +1,156 @@
+// watchlimit.go
+//
+// Watch-descriptor budgeting: detecting when the platform (or a
+// self-imposed cap set via SetMaxWatches) has run out of native watches,
+// and falling back to periodically polling the affected directory's
+// immediate entries instead of leaving it unwatched.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// ErrWatchLimitReached is the errors.Is target for WatchLimitError.
+var ErrWatchLimitReached = errors.New("syncwatcher: watch limit reached")
+
+// WatchLimitError is sent on the Error channel when SyncWatcher could not
+// add a native watch for Path, either because the platform's own watch
+// descriptor budget (e.g. Linux's fs.inotify.max_user_watches) was
+// exhausted, or because the cap set by SetMaxWatches was reached. Path is
+// instead polled periodically: entries added, removed or renamed directly
+// in Path are reported after a delay. Changes to the contents of existing
+// entries, and changes inside subdirectories that already existed when
+// polling began, are not reported.
+type WatchLimitError struct {
+	Path       string
+	WatchCount int
+}
+
+func (e *WatchLimitError) Error() string {
+	return fmt.Sprintf("syncwatcher: watch limit reached at %d watches, falling back to polling for %s", e.WatchCount, e.Path)
+}
+
+func (e *WatchLimitError) Is(target error) bool {
+	return target == ErrWatchLimitReached
+}
+
+// isWatchLimitError reports whether err is the platform telling us it is
+// out of watch descriptors or file descriptors: inotify's ENOSPC (exceeded
+// fs.inotify.max_user_watches), or EMFILE/ENFILE (too many open files,
+// process- or system-wide).
+func isWatchLimitError(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
+
+// SuggestSysctl returns the sysctl command that raises Linux's
+// fs.inotify.max_user_watches limit, the most common cause of watch
+// exhaustion when recursively watching large trees.
+func SuggestSysctl() string {
+	return "sudo sysctl fs.inotify.max_user_watches=204800"
+}
+
+// SetMaxWatches caps the number of native watches this SyncWatcher will
+// hold at once. Once the cap is reached, new subdirectories are polled
+// instead of watched, rather than refused outright. A cap of 0, the
+// default, means unlimited (subject only to the platform's own limit).
+func (w *SyncWatcher) SetMaxWatches(n int) {
+	w.pathMutex.Lock()
+	w.maxWatches = n
+	w.pathMutex.Unlock()
+}
+
+// WatchCount returns the number of directories currently held under a
+// native watch. It does not count directories that have fallen back to
+// polling.
+func (w *SyncWatcher) WatchCount() int {
+	w.pathMutex.Lock()
+	defer w.pathMutex.Unlock()
+	return len(w.paths)
+}
+
+// reportWatchLimitLocked notifies the caller that path could not be
+// watched. The send is non-blocking: if nothing is currently receiving on
+// Error, the notification is dropped rather than leaking a goroutine per
+// watch-limit hit. The polling fallback proceeds either way. Callers must
+// hold pathMutex.
+func (w *SyncWatcher) reportWatchLimitLocked(path string) {
+	select {
+	case w.Error <- &WatchLimitError{Path: path, WatchCount: len(w.paths)}:
+	default:
+	}
+}
+
+// pollInterval is how often an unwatchable subtree is re-listed. It's a
+// var, not a const, so tests can shrink it rather than waiting out the
+// real interval.
+var pollInterval = 10 * time.Second
+
+// startPollingLocked begins periodically polling path for changes in place
+// of a native watch. It is idempotent: polling an already-polled path is a
+// no-op. Callers must hold pathMutex.
+func (w *SyncWatcher) startPollingLocked(path string) {
+	if w.polling == nil {
+		w.polling = make(map[string]chan struct{})
+	}
+	if _, already := w.polling[path]; already {
+		return
+	}
+
+	stop := make(chan struct{})
+	w.polling[path] = stop
+	w.snapshots[path] = snapshotDir(path)
+
+	w.pollWG.Add(1)
+	go w.pollLoop(path, stop)
+}
+
+// pollLoop re-lists path every pollInterval and emits the Create/Rename/
+// Remove events implied by whatever changed directly in it, via the same
+// rescanDir diffing used for kqueue/FEN directories. Newly discovered
+// subdirectories go back through watch(), so they pick up a native watch
+// as soon as the budget allows. It runs until path disappears or stop is
+// closed, which
+// Close() both triggers and waits for (via pollWG) before it's safe to
+// close w.Event out from under any pending send below.
+func (w *SyncWatcher) pollLoop(path string, stop chan struct{}) {
+	defer w.pollWG.Done()
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if _, err := os.Lstat(path); err != nil {
+				// The polled directory is gone; nothing more to do here.
+				return
+			}
+			for _, ev := range w.rescanDir(path) {
+				select {
+				case w.Event <- ev:
+				case <-stop:
+					return
+				}
+				// Mirror to the batcher too, exactly like the inotify/
+				// kqueue/FEN path's emit closure in newSyncWatcher, so a
+				// subtree that's degraded to polling still participates
+				// in NewSyncWatcherWithDelay's coalescing instead of
+				// going silent on sw.Batch.
+				if w.toBatcher != nil {
+					select {
+					case w.toBatcher <- ev:
+					case <-stop:
+						return
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// watchlimit_test.go
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestSuggestSysctl(t *testing.T) {
+	cmd := SuggestSysctl()
+	if !strings.Contains(cmd, "fs.inotify.max_user_watches") {
+		t.Error("expected SuggestSysctl to mention fs.inotify.max_user_watches, got:", cmd)
+	}
+}
+
+func TestWatchCount(t *testing.T) {
+	sw := &SyncWatcher{
+		paths:     map[string]string{"/a": "", "/a/b": ""},
+		pathMutex: &sync.Mutex{},
+	}
+	if got := sw.WatchCount(); got != 2 {
+		t.Error("expected WatchCount to report 2 watched directories, got:", got)
+	}
+}
+
+func TestIsWatchLimitError(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{syscall.ENOSPC, true},
+		{syscall.EMFILE, true},
+		{syscall.ENFILE, true},
+		{syscall.ENOENT, false},
+		{nil, false},
+	}
+	for _, c := range cases {
+		if got := isWatchLimitError(c.err); got != c.want {
+			t.Errorf("isWatchLimitError(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+func TestSetMaxWatchesFallsBackToPolling(t *testing.T) {
+	dir := filepath.Join(tmpdir, fmt.Sprintf("maxwatches.%d", os.Getpid()))
+	mkdir(t, dir)
+	defer removeAll(t, dir)
+	sub := filepath.Join(dir, "sub")
+	mkdir(t, sub)
+
+	sw := newSW(t)
+	defer sw.Close()
+
+	// Drain both outgoing channels in the background. The WatchLimitError
+	// send is non-blocking, so it is only seen if a receiver on sw.Error
+	// is already waiting when watch() below reaches the cap.
+	go func() {
+		for range sw.Event {
+		}
+	}()
+	var gotLimitErr bool
+	ready := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		close(ready)
+		for err := range sw.Error {
+			if _, ok := err.(*WatchLimitError); ok {
+				gotLimitErr = true
+			}
+		}
+	}()
+	<-ready
+
+	// Cap at 1: watching dir itself consumes the one available watch, so
+	// the walk into sub must fall back to polling.
+	sw.SetMaxWatches(1)
+	watch(t, sw, dir)
+
+	sw.pathMutex.Lock()
+	_, polling := sw.polling[sub]
+	sw.pathMutex.Unlock()
+	if !polling {
+		t.Error("expected sub to have fallen back to polling once maxWatches was reached")
+	}
+
+	sw.Close()
+	<-done
+	if !gotLimitErr {
+		t.Error("expected a WatchLimitError on sw.Error")
+	}
+}
+
+func TestPollLoopEmitsEvents(t *testing.T) {
+	dir := filepath.Join(tmpdir, fmt.Sprintf("pollloop.%d", os.Getpid()))
+	mkdir(t, dir)
+	defer removeAll(t, dir)
+
+	sw := &SyncWatcher{
+		Event:     make(chan fsnotify.Event),
+		roots:     map[string]int{dir: 1},
+		paths:     map[string]string{dir: ""},
+		snapshots: make(map[string]map[string]time.Time),
+		polling:   make(map[string]chan struct{}),
+		pathMutex: &sync.Mutex{},
+	}
+	sw.snapshots[dir] = snapshotDir(dir)
+
+	old := pollInterval
+	pollInterval = 10 * time.Millisecond
+	defer func() { pollInterval = old }()
+
+	stop := make(chan struct{})
+	sw.pollWG.Add(1)
+	go sw.pollLoop(dir, stop)
+
+	newFile := filepath.Join(dir, "polled")
+	createEmptyFile(t, newFile)
+
+	timeout := time.After(2 * time.Second)
+	select {
+	case ev := <-sw.Event:
+		if !ev.Op.Has(fsnotify.Create) || ev.Name != newFile {
+			t.Errorf("expected a create event for %s, got %v", newFile, ev)
+		}
+	case <-timeout:
+		t.Fatal("no event received from pollLoop")
+	}
+
+	close(stop)
+	sw.pollWG.Wait()
+}